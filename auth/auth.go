@@ -0,0 +1,161 @@
+// Package auth implements the authorization checks disadis performs
+// before handing back a datastream: is the requester an admin, do they
+// have a current session identifying them as a user, or does the
+// request carry a signature granting it the object in question.
+// Object-level policy stored in Fedora is not consulted.
+package auth
+
+import (
+	"net/http"
+
+	"github.com/dbrower/disadis/metrics"
+)
+
+// AuthResult is the outcome of an authorization check.
+type AuthResult int
+
+const (
+	// AuthAllow means the request may proceed.
+	AuthAllow AuthResult = iota
+	// AuthDeny means the request is understood but not permitted.
+	AuthDeny
+	// AuthNotFound means the object does not exist, or existence
+	// should not be revealed to this requester.
+	AuthNotFound
+	// AuthError means something went wrong while deciding.
+	AuthError
+	// AuthGone means the request was once valid but no longer is --
+	// e.g. a signed URL whose expiry has passed.
+	AuthGone
+)
+
+// User identifies whoever is making the current request.
+type User struct {
+	Id string
+}
+
+// CurrentUser extracts the identity of the requester, if any, from an
+// incoming request. PubtktAuth and DeviseAuth are implementations.
+type CurrentUser interface {
+	User(r *http.Request) (User, bool)
+}
+
+// UserRecorder may be implemented by an http.ResponseWriter wrapper to
+// capture the identity HydraAuth.Check already determined for the
+// current request, so that something downstream of the handler (e.g.
+// access logging) can reuse it instead of asking CurrentUser again.
+type UserRecorder interface {
+	SetUser(User)
+}
+
+// PidAuthorizer may be implemented by a CurrentUser which can decide,
+// by itself, whether a request may access a specific pid -- bypassing
+// Fedora policy and the admin list entirely. SignedURLAuth is the
+// only current implementation: a valid signature is itself the grant.
+// handled is false if this CurrentUser has nothing to say about the
+// request, in which case HydraAuth falls back to its normal checks.
+type PidAuthorizer interface {
+	AuthorizePid(r *http.Request, pid string) (result AuthResult, handled bool)
+}
+
+// WWWAuthenticater may be implemented by a CurrentUser to supply the
+// value of the WWW-Authenticate header sent alongside a 401 response.
+type WWWAuthenticater interface {
+	WWWAuthenticate() string
+}
+
+// HydraAuth decides whether a request for a given pid is permitted. It
+// always allows admins. If CurrentUser is set, it is used to identify
+// the requester: an identified requester is allowed and an unidentified
+// one is denied. If it is nil, every request is allowed. Object-level
+// policy is not consulted in either case.
+type HydraAuth struct {
+	// Admin holds the user ids which may access anything.
+	Admin []string
+
+	// CurrentUser identifies the requester of a request, if any.
+	// May be left nil, in which case every request is allowed.
+	CurrentUser CurrentUser
+}
+
+// NewHydraAuth returns an empty HydraAuth. fedoraAddr and prefix are
+// not used: no object-level policy is fetched from Fedora.
+func NewHydraAuth(fedoraAddr, prefix string) *HydraAuth {
+	return &HydraAuth{}
+}
+
+// Check decides whether the given request may access pid. It also
+// returns the identity it determined for the requester, if any, so
+// that a caller which needs it too (e.g. for access logging) does not
+// have to ask CurrentUser a second time -- which, for DeviseAuth, means
+// a second database query on every request.
+func (h *HydraAuth) Check(r *http.Request, pid string) (AuthResult, User, bool) {
+	result, user, ok := h.check(r, pid)
+	metrics.AuthDecisions.WithLabelValues(authOutcome(result)).Inc()
+	return result, user, ok
+}
+
+func (h *HydraAuth) check(r *http.Request, pid string) (AuthResult, User, bool) {
+	// A PidAuthorizer (e.g. SignedURLAuth) may settle the request for
+	// this pid entirely by itself, bypassing admin/public policy below.
+	if pa, ok := h.CurrentUser.(PidAuthorizer); ok {
+		if result, handled := pa.AuthorizePid(r, pid); handled {
+			return result, User{}, false
+		}
+	}
+
+	user, ok := h.identify(r)
+	if ok && h.isAdmin(user) {
+		return AuthAllow, user, ok
+	}
+	if h.CurrentUser == nil {
+		// no way to identify anyone: every request is allowed
+		return AuthAllow, user, ok
+	}
+	if !ok {
+		return AuthDeny, user, ok
+	}
+	return AuthAllow, user, ok
+}
+
+// WWWAuthenticate returns the value to use in a WWW-Authenticate header
+// sent alongside a 401 response, or "" if CurrentUser does not have an
+// opinion.
+func (h *HydraAuth) WWWAuthenticate() string {
+	if wa, ok := h.CurrentUser.(WWWAuthenticater); ok {
+		return wa.WWWAuthenticate()
+	}
+	return ""
+}
+
+func authOutcome(result AuthResult) string {
+	switch result {
+	case AuthAllow:
+		return "allow"
+	case AuthDeny:
+		return "deny"
+	case AuthNotFound:
+		return "notfound"
+	case AuthGone:
+		return "gone"
+	default:
+		return "error"
+	}
+}
+
+// identify returns the identity of the requester, if any.
+func (h *HydraAuth) identify(r *http.Request) (User, bool) {
+	if h.CurrentUser == nil {
+		return User{}, false
+	}
+	return h.CurrentUser.User(r)
+}
+
+func (h *HydraAuth) isAdmin(u User) bool {
+	for _, a := range h.Admin {
+		if a == u.Id {
+			return true
+		}
+	}
+	return false
+}
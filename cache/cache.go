@@ -0,0 +1,168 @@
+// Package cache implements a size-bounded, on-disk cache of Fedora
+// datastream content. Entries are keyed by pid, datastream name and
+// Fedora's VersionID, so a new object version is always a different
+// key; stale content is never served, and old versions simply age out
+// under the cache's LRU eviction.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dbrower/disadis/metrics"
+)
+
+// Cache is an on-disk cache of datastream content. Its evictor trims
+// it back to maxSizeBytes total on each run. Put does not check object
+// sizes; callers compare against MaxObjectBytes before calling it.
+type Cache struct {
+	dir            string
+	maxSize        int64
+	maxObjectBytes int64
+}
+
+// New returns a Cache rooted at dir, creating it if necessary.
+// maxObjectBytes <= 0 means "unbounded": an object may be cached up to
+// maxSizeBytes, since nothing larger could ever fit regardless. This
+// keeps an operator who sets max_size_bytes but forgets
+// max_object_bytes from ending up with a cache that silently stores
+// nothing.
+func New(dir string, maxSizeBytes, maxObjectBytes int64) *Cache {
+	os.MkdirAll(dir, 0755)
+	if maxObjectBytes <= 0 {
+		maxObjectBytes = maxSizeBytes
+	}
+	log.Printf("Datastream cache at %s: max size %d bytes, max object size %d bytes",
+		dir, maxSizeBytes, maxObjectBytes)
+	return &Cache{dir: dir, maxSize: maxSizeBytes, maxObjectBytes: maxObjectBytes}
+}
+
+// MaxObjectBytes is the largest object size this cache will store.
+// Callers should skip Put for anything larger.
+func (c *Cache) MaxObjectBytes() int64 {
+	return c.maxObjectBytes
+}
+
+// Get opens the cached content for pid/ds/versionID, if present. A
+// hit refreshes the entry's mtime, so the evictor's LRU ordering
+// treats it as recently used.
+func (c *Cache) Get(pid, ds, versionID string) (*os.File, int64, bool) {
+	path := c.path(pid, ds, versionID)
+	f, err := os.Open(path)
+	if err != nil {
+		metrics.CacheMisses.Inc()
+		return nil, 0, false
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		metrics.CacheMisses.Inc()
+		return nil, 0, false
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	metrics.CacheHits.Inc()
+	return f, fi.Size(), true
+}
+
+// Writer receives the content of a single cache entry and must be
+// finished with Commit or Abort.
+type Writer struct {
+	f     *os.File
+	tmp   string
+	final string
+}
+
+// Put begins writing a new cache entry for pid/ds/versionID. The
+// entry is written to a temporary file and only appears under its
+// final name once Commit is called, so concurrent readers never see
+// a partial object.
+func (c *Cache) Put(pid, ds, versionID string) (*Writer, error) {
+	f, err := os.CreateTemp(c.dir, "tmp-")
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{f: f, tmp: f.Name(), final: c.path(pid, ds, versionID)}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	return w.f.Write(p)
+}
+
+// Commit closes the entry and atomically installs it into the cache.
+func (w *Writer) Commit() error {
+	if err := w.f.Close(); err != nil {
+		os.Remove(w.tmp)
+		return err
+	}
+	return os.Rename(w.tmp, w.final)
+}
+
+// Abort discards a partially written entry, e.g. because the client
+// disconnected before the whole datastream had been received.
+func (w *Writer) Abort() {
+	w.f.Close()
+	os.Remove(w.tmp)
+}
+
+// path returns the on-disk path for a cache key. Keys are hashed,
+// rather than derived directly from pid and ds, so that pids
+// containing slashes or other path-unsafe characters can't escape
+// the cache directory or collide with each other.
+func (c *Cache) path(pid, ds, versionID string) string {
+	h := sha256.Sum256([]byte(pid + "\x00" + ds + "\x00" + versionID))
+	return filepath.Join(c.dir, hex.EncodeToString(h[:]))
+}
+
+// RunEvictor periodically removes the least-recently-used entries
+// until the cache is back under its configured size. It never
+// returns; callers run it in its own goroutine.
+func (c *Cache) RunEvictor(interval time.Duration) {
+	for {
+		c.evictOnce()
+		time.Sleep(interval)
+	}
+}
+
+func (c *Cache) evictOnce() {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	type fileInfo struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var files []fileInfo
+	var total int64
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), "tmp-") {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		total += fi.Size()
+		files = append(files, fileInfo{filepath.Join(c.dir, e.Name()), fi.Size(), fi.ModTime()})
+	}
+	if total <= c.maxSize {
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for _, f := range files {
+		if total <= c.maxSize {
+			break
+		}
+		if os.Remove(f.path) == nil {
+			total -= f.size
+		}
+	}
+}
@@ -8,14 +8,13 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
-	"sync"
 	"syscall"
 	"time"
 
 	"code.google.com/p/gcfg"
 	_ "github.com/go-sql-driver/mysql"
 
-	"github.com/dbrower/disadis/auth"
+	"github.com/dbrower/disadis/cache"
 	"github.com/dbrower/disadis/fedora"
 )
 
@@ -50,21 +49,41 @@ func (li *loginfo) Reopen() {
 	li.f = newf
 }
 
-func signalHandler(sig <-chan os.Signal, logw Reopener) {
+// signalHandler runs until a SIGTERM or SIGINT is received, at which
+// point it shuts lc down and returns.
+func signalHandler(sig <-chan os.Signal, logw Reopener, lc *lifecycle) {
 	for s := range sig {
 		log.Println("---Got", s)
 		switch s {
 		case syscall.SIGUSR1:
 			logw.Reopen()
+		case syscall.SIGHUP:
+			lc.Reload()
+		case syscall.SIGTERM, syscall.SIGINT:
+			lc.Shutdown()
+			log.Println("-----Server Shutdown Complete")
+			return
 		}
 	}
 }
 
+// openRailsDB opens the mysql database holding the Rails application's
+// user table.
+func openRailsDB(database string) (*sql.DB, error) {
+	return sql.Open("mysql", database)
+}
+
 type Config struct {
 	General struct {
-		Log_filename string
-		Fedora_addr  string
-		Admin        []string
+		Log_filename     string
+		Fedora_addr      string
+		Admin            []string
+		Metrics_port     string
+		Log_format       string
+		Shutdown_grace   string
+		Max_concurrency  int
+		Max_queue_length int
+		Queue_timeout    string
 	}
 	Pubtkt struct {
 		Key_file string
@@ -74,14 +93,49 @@ type Config struct {
 		Cookie   string
 		Database string
 	}
-	Handler map[string]*struct {
-		Port          string
-		Auth          bool
-		Versioned     bool
-		Prefix        string
-		Datastream    string
-		Datastream_id []string
-	}
+	Signedurl struct {
+		// Secret is the HMAC key used to sign and verify download
+		// links. Leave unset to disable signed-URL authentication.
+		Secret string
+		// Max_ttl bounds how far in the future a link's expiry may be,
+		// as a duration string (e.g. "24h"). Empty means no limit.
+		Max_ttl string
+		// Bind_ip requires a signed link to also be stamped to the
+		// remote IP it was issued to.
+		Bind_ip bool
+	}
+	Cache struct {
+		// Dir, if set, enables an on-disk cache of datastream content
+		// for hot pids, rooted at this directory.
+		Dir              string
+		Max_size_bytes   int64
+		Max_object_bytes int64
+	}
+	Handler map[string]*HandlerConfig
+}
+
+// HandlerConfig describes a single disadis handler: what pid prefix
+// and datastream it serves, on what port, and under what name(s).
+type HandlerConfig struct {
+	Port          string
+	Auth          bool
+	Versioned     bool
+	Prefix        string
+	Datastream    string
+	Datastream_id []string
+
+	// Per-handler overrides of Config.General's Fedora queueing
+	// limits. Zero/empty means "use the General setting".
+	Max_concurrency  int
+	Max_queue_length int
+	Queue_timeout    string
+
+	// Public_cache, if true, sends "public, max-age=Cache_max_age"
+	// instead of the default "private" Cache-Control header. Only
+	// appropriate for handlers whose response doesn't vary by
+	// requester.
+	Public_cache  bool
+	Cache_max_age int
 }
 
 func main() {
@@ -126,6 +180,12 @@ func main() {
 		secret = config.Rails.Secret
 		database = config.Rails.Database
 		cookieName = config.Rails.Cookie
+	} else {
+		config.General.Fedora_addr = fedoraAddr
+		config.Pubtkt.Key_file = pubtktKey
+		config.Rails.Secret = secret
+		config.Rails.Database = database
+		config.Rails.Cookie = cookieName
 	}
 
 	/* first set up the log file */
@@ -134,126 +194,45 @@ func main() {
 	logw.Reopen()
 	log.Println("-----Starting Server")
 
-	/* set up signal handlers */
-	sig := make(chan os.Signal, 5)
-	signal.Notify(sig, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
-	go signalHandler(sig, logw)
-
 	/* Now set up the handler chains */
 	if fedoraAddr == "" {
 		log.Printf("Error: Fedora address must be set. (--fedora <server addr>)")
 		os.Exit(1)
 	}
-	fedora := fedora.NewRemote(fedoraAddr, "")
-	ha := auth.NewHydraAuth(fedoraAddr, "")
-	ha.Admin = config.General.Admin
-	log.Println("Admin users:", ha.Admin)
-	switch {
-	case pubtktKey != "":
-		log.Printf("Using pubtkt %s", pubtktKey)
-		ha.CurrentUser = auth.NewPubtktAuthFromKeyFile(pubtktKey)
-	case secret != "":
-		log.Printf("Using Rails 3 cookies")
-		if cookieName == "" {
-			log.Printf("Warning: The name of the cookie holding the rails session is required (--cookie)")
-			break
-		}
-		log.Printf("Cookie name '%s'", cookieName)
-		if database == "" {
-			log.Printf("Warning: A database (--db) is required to use rails cookies")
-			break
-		}
-		db, err := sql.Open("mysql", database)
-		if err != nil {
-			log.Printf("Error opening database connection: %s", err)
-			break
-		}
-		ha.CurrentUser = &auth.DeviseAuth{
-			SecretBase: []byte(secret),
-			CookieName: cookieName,
-			Lookup:     &auth.DatabaseUser{Db: db},
-		}
-	default:
-		log.Printf("Warning: No authorization method given.")
-	}
-	if ha.CurrentUser == nil {
-		log.Printf("Warning: Only Allowing Public Access.")
-	}
 	if len(config.Handler) == 0 {
 		log.Printf("No Handlers are defined. Exiting.")
 		return
 	}
 
-	runHandlers(config, fedora, ha)
-}
-
-type handlerBootstrap struct {
-	h    http.Handler
-	name string
-}
+	if config.General.Log_format != "" {
+		setAccessLogFormat(config.General.Log_format)
+	}
+	serveMetrics(config.General.Metrics_port)
 
-// runHandlers starts a listener for each port in its own goroutine
-// and then waits for all of them to quit.
-func runHandlers(config Config, fedora fedora.Fedora, auth *auth.HydraAuth) {
-	var wg sync.WaitGroup
-	portHandlers := make(map[string]*DsidMux)
-	// first create the handlers
-	for k, v := range config.Handler {
-		h := &DownloadHandler{
-			Fedora:    fedora,
-			Ds:        v.Datastream,
-			Versioned: v.Versioned,
-			Prefix:    v.Prefix,
-		}
-		if v.Auth {
-			h.Auth = auth
-		}
-		log.Printf("Handler %s (datastream %s, port %s, auth %v, dsid %v)",
-			k,
-			v.Datastream,
-			v.Port,
-			v.Auth,
-			v.Datastream_id)
-		mux, ok := portHandlers[v.Port]
-		if !ok {
-			mux = &DsidMux{}
-			portHandlers[v.Port] = mux
-		}
-		// see http://golang.org/doc/faq#closures_and_goroutines
-		k := k // make local ref to var for closure
-		hh := http.HandlerFunc(
-			func(w http.ResponseWriter, r *http.Request) {
-				t := time.Now()
-				realip := r.Header.Get("X-Real-IP")
-				if realip == "" {
-					realip = r.RemoteAddr
-				}
-				h.ServeHTTP(w, r)
-				log.Printf("%s %s %s %s %v",
-					k,
-					realip,
-					r.Method,
-					r.RequestURI,
-					time.Now().Sub(t))
-			})
-		if len(v.Datastream_id) == 0 {
-			mux.DefaultHandler = hh
-		}
-		for _, name := range v.Datastream_id {
-			if name == "default" {
-				mux.DefaultHandler = hh
-			} else {
-				mux.AddHandler(name, hh)
-			}
+	grace := 30 * time.Second
+	if config.General.Shutdown_grace != "" {
+		d, err := time.ParseDuration(config.General.Shutdown_grace)
+		if err != nil {
+			log.Printf("Invalid shutdown_grace %q, using default of %s", config.General.Shutdown_grace, grace)
+		} else {
+			grace = d
 		}
 	}
-	// now start a goroutine for each port
-	for port, h := range portHandlers {
-		wg.Add(1)
-		go http.ListenAndServe(":"+port, h)
-	}
+
 	// Listen on 6060 to get pprof output
 	go http.ListenAndServe(":6060", nil)
-	// We add things to the waitgroup, but never call wg.Done(). This will never return.
-	wg.Wait()
+
+	var dsCache *cache.Cache
+	if config.Cache.Dir != "" {
+		dsCache = cache.New(config.Cache.Dir, config.Cache.Max_size_bytes, config.Cache.Max_object_bytes)
+		go dsCache.RunEvictor(5 * time.Minute)
+	}
+
+	lc := newLifecycle(configFile, fedoraAddr, grace, logw, fedora.NewRemote(fedoraAddr, ""), dsCache)
+	lc.Start(config)
+
+	/* set up signal handlers; blocks here until shut down */
+	sig := make(chan os.Signal, 5)
+	signal.Notify(sig, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGTERM, syscall.SIGINT)
+	signalHandler(sig, logw, lc)
 }
@@ -1,14 +1,21 @@
 package disseminator
 
 import (
+	"fmt"
 	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
+	"os"
 	"strings"
 	"strconv"
 
 	"github.com/dbrower/disadis/auth"
+	"github.com/dbrower/disadis/cache"
 	"github.com/dbrower/disadis/fedora"
+	"github.com/dbrower/disadis/metrics"
+	"github.com/dbrower/disadis/queueing"
 )
 
 // Handles the route
@@ -56,6 +63,25 @@ type DownloadHandler struct {
 	Versioned bool
 	Prefix string
 	Auth *auth.HydraAuth
+
+	// Queue, if set, bounds how many requests may be waiting on or
+	// talking to Fedora at once. Requests that cannot get a slot are
+	// answered with 503 rather than piling up against Fedora.
+	Queue *queueing.Queue
+
+	// Cache, if set, is consulted once the datastream profile has been
+	// fetched, before Fedora is asked for content, for whole and ranged
+	// requests alike. A whole-datastream request that misses populates
+	// it so later requests for the same VersionID are served from
+	// disk; a ranged request that misses does not.
+	Cache *cache.Cache
+
+	// PublicCache, if true, serves a "public, max-age=CacheMaxAge"
+	// Cache-Control header instead of the default "private". Only
+	// appropriate for handlers whose response does not vary by
+	// requester.
+	PublicCache bool
+	CacheMaxAge int
 }
 
 func NewDownloadHandler(f fedora.Fedora) http.Handler {
@@ -69,8 +95,6 @@ func notFound(w http.ResponseWriter) {
 }
 
 func (dh *DownloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Printf("%s %s", r.Method, r.URL.Path)
-
 	if r.Method != "GET" {
 		notFound(w)
 		return
@@ -88,14 +112,25 @@ func (dh *DownloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	)
 	// auth?
 	if dh.Auth != nil {
-		switch dh.Auth.Check(r, pid) {
+		result, user, identified := dh.Auth.Check(r, pid)
+		if identified {
+			if rec, ok := w.(auth.UserRecorder); ok {
+				rec.SetUser(user)
+			}
+		}
+		switch result {
 		case auth.AuthDeny:
-			// TODO: add WWW-Authenticate header field
+			if wa := dh.Auth.WWWAuthenticate(); wa != "" {
+				w.Header().Set("WWW-Authenticate", wa)
+			}
 			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
 			return
 		case auth.AuthNotFound:
 			notFound(w)
 			return
+		case auth.AuthGone:
+			http.Error(w, "410 Gone", http.StatusGone)
+			return
 		case auth.AuthAllow:
 			break
 		case auth.AuthError:
@@ -124,6 +159,18 @@ func (dh *DownloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// queue behind Fedora, if a limit is configured, so a spike on one
+	// popular pid cannot open unbounded concurrent Fedora requests
+	if dh.Queue != nil {
+		release, err := dh.Queue.Acquire()
+		if err != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(int(dh.Queue.RetryAfter().Seconds())))
+			http.Error(w, "503 Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		defer release()
+	}
+
 	dsinfo, err := dh.Fedora.GetDatastreamInfo(pid, dh.Ds)
 	if err != nil {
 		log.Println(err)
@@ -149,32 +196,182 @@ func (dh *DownloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// return content
-	content, info, err := dh.Fedora.GetDatastream(pid, dh.Ds)
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Disposition", `inline; filename="`+dsinfo.Label+`"`)
+	w.Header().Set("Content-Transfer-Encoding", "binary")
+	if dh.PublicCache {
+		maxAge := dh.CacheMaxAge
+		if maxAge <= 0 {
+			maxAge = 60
+		}
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
+	} else {
+		w.Header().Set("Cache-Control", "private")
+	}
+	w.Header().Set("ETag", dsinfo.VersionID)
+
+	// A Range header is only honored if there is no If-Range, or the
+	// If-Range value matches the ETag we would send. Otherwise we fall
+	// back to sending the entire datastream, per RFC 7233 Section 3.2.
+	rangeHeader := r.Header.Get("Range")
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && ifRange != dsinfo.VersionID {
+		rangeHeader = ""
+	}
+
+	size, err := strconv.ParseInt(dsinfo.Length, 10, 64)
 	if err != nil {
-		switch err {
-		case fedora.FedoraNotFound:
-			notFound(w)
+		log.Println("Error parsing dsinfo.Length", dsinfo.Length, err)
+		notFound(w)
+		return
+	}
+
+	ranges, err := parseRange(rangeHeader, size)
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		http.Error(w, "416 Requested Range Not Satisfiable", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	if dh.Cache != nil {
+		if f, cachedSize, ok := dh.Cache.Get(pid, dh.Ds, dsinfo.VersionID); ok {
+			defer f.Close()
+			dh.serveFromCache(w, f, cachedSize, dsinfo, ranges, size)
 			return
-		default:
-			log.Printf("Got fedora error: %s", err)
-			http.Error(w, "500 Internal Error", http.StatusInternalServerError)
+		}
+	}
+
+	switch len(ranges) {
+	case 0:
+		// no Range header (or it was overridden by If-Range): send the
+		// whole datastream
+		content, info, err := dh.Fedora.GetDatastream(pid, dh.Ds)
+		if err != nil {
+			dh.fedoraError(w, err)
 			return
 		}
+		defer content.Close()
+		w.Header().Set("Content-Type", info.Type)
+		w.Header().Set("Content-Length", info.Length)
+		dh.copyAndCache(w, content, pid, dsinfo.VersionID, size)
+	case 1:
+		ra := ranges[0]
+		content, info, err := dh.Fedora.GetDatastreamRange(pid, dh.Ds, ra.start, ra.length())
+		if err != nil {
+			dh.fedoraError(w, err)
+			return
+		}
+		defer content.Close()
+		w.Header().Set("Content-Type", info.Type)
+		w.Header().Set("Content-Length", strconv.FormatInt(ra.length(), 10))
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", ra.start, ra.end, size))
+		w.WriteHeader(http.StatusPartialContent)
+		io.Copy(w, content)
+	default:
+		dh.serveMultipartRanges(w, pid, dsinfo, ranges, size)
 	}
-	defer content.Close()
+}
 
-	// sometimes fedora appends an extra extension. see FCREPO-497 in the
-	// fedora commons JIRA.
-	w.Header().Set("Content-Type", info.Type)
-	w.Header().Set("Content-Length", info.Length)
-	w.Header().Set("Content-Disposition", `inline; filename="` + dsinfo.Label + `"`)
-	w.Header().Set("Content-Transfer-Encoding", "binary")
-	w.Header().Set("Cache-Control", "private")
-	w.Header().Set("ETag", dsinfo.VersionID)
+// fedoraError maps an error returned by the Fedora client onto the
+// appropriate HTTP response.
+func (dh *DownloadHandler) fedoraError(w http.ResponseWriter, err error) {
+	switch err {
+	case fedora.FedoraNotFound:
+		notFound(w)
+	default:
+		log.Printf("Got fedora error: %s", err)
+		http.Error(w, "500 Internal Error", http.StatusInternalServerError)
+	}
+}
+
+// copyAndCache streams content to w, teeing it into dh.Cache's entry
+// for pid/versionID if caching is enabled and the object isn't too
+// large. A partial or interrupted copy aborts the cache entry rather
+// than committing incomplete content.
+func (dh *DownloadHandler) copyAndCache(w http.ResponseWriter, content io.Reader, pid, versionID string, size int64) {
+	if dh.Cache == nil || size > dh.Cache.MaxObjectBytes() {
+		io.Copy(w, content)
+		return
+	}
+	cw, err := dh.Cache.Put(pid, dh.Ds, versionID)
+	if err != nil {
+		log.Printf("Error opening cache entry for %s: %s", pid, err)
+		io.Copy(w, content)
+		return
+	}
+	n, err := io.Copy(io.MultiWriter(w, cw), content)
+	if err == nil && n == size {
+		if err := cw.Commit(); err != nil {
+			log.Printf("Error committing cache entry for %s: %s", pid, err)
+		}
+	} else {
+		cw.Abort()
+	}
+}
+
+// serveFromCache answers a request (whole or ranged) directly from an
+// already-open cache entry, using the Type already known from dsinfo.
+func (dh *DownloadHandler) serveFromCache(w http.ResponseWriter, f *os.File, cachedSize int64, dsinfo fedora.DsInfo, ranges []byteRange, size int64) {
+	switch len(ranges) {
+	case 0:
+		w.Header().Set("Content-Type", dsinfo.Type)
+		w.Header().Set("Content-Length", strconv.FormatInt(cachedSize, 10))
+		n, _ := io.Copy(w, f)
+		metrics.CacheBytesServed.Add(float64(n))
+	case 1:
+		ra := ranges[0]
+		w.Header().Set("Content-Type", dsinfo.Type)
+		w.Header().Set("Content-Length", strconv.FormatInt(ra.length(), 10))
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", ra.start, ra.end, size))
+		w.WriteHeader(http.StatusPartialContent)
+		f.Seek(ra.start, io.SeekStart)
+		n, _ := io.CopyN(w, f, ra.length())
+		metrics.CacheBytesServed.Add(float64(n))
+	default:
+		mw := multipart.NewWriter(w)
+		w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+		w.WriteHeader(http.StatusPartialContent)
+		for _, ra := range ranges {
+			part, err := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Type":  {dsinfo.Type},
+				"Content-Range": {fmt.Sprintf("bytes %d-%d/%d", ra.start, ra.end, size)},
+			})
+			if err != nil {
+				continue
+			}
+			f.Seek(ra.start, io.SeekStart)
+			n, _ := io.CopyN(part, f, ra.length())
+			metrics.CacheBytesServed.Add(float64(n))
+		}
+		mw.Close()
+	}
+}
+
+// serveMultipartRanges writes a 206 Partial Content response whose body
+// is a multipart/byteranges document, one part per requested range, as
+// described in RFC 7233 Section 4.1. info is the profile ServeHTTP
+// already fetched, reused here for its content type rather than
+// re-fetched.
+func (dh *DownloadHandler) serveMultipartRanges(w http.ResponseWriter, pid string, info fedora.DsInfo, ranges []byteRange, size int64) {
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	w.WriteHeader(http.StatusPartialContent)
 
-	io.Copy(w, content)
-	return
+	for _, ra := range ranges {
+		content, err := dh.Fedora.GetContentRange(pid, dh.Ds, ra.start, ra.length())
+		if err != nil {
+			log.Printf("Got fedora error serving range %v: %s", ra, err)
+			return
+		}
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":  {info.Type},
+			"Content-Range": {fmt.Sprintf("bytes %d-%d/%d", ra.start, ra.end, size)},
+		})
+		if err == nil {
+			io.Copy(part, content)
+		}
+		content.Close()
+	}
+	mw.Close()
 }
 
 // returns -1 on error
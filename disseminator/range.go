@@ -0,0 +1,110 @@
+package disseminator
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// byteRange is a single, resolved (i.e. already clamped to a known
+// total size) byte range, with end being inclusive, matching the HTTP
+// Range header convention.
+type byteRange struct {
+	start, end int64 // inclusive, 0-based
+}
+
+func (r byteRange) length() int64 {
+	return r.end - r.start + 1
+}
+
+// errNoOverlap is returned by parseRange when none of the requested
+// ranges overlap the resource, i.e. the request should be answered
+// with 416 Requested Range Not Satisfiable.
+var errNoOverlap = errors.New("disseminator: invalid range: failed to overlap")
+
+// maxRanges bounds how many ranges a single request may ask for. Each
+// one becomes a separate Fedora round trip in serveMultipartRanges, so
+// without a cap a single request ("Range: bytes=0-0,0-0,...") could
+// fan out into an unbounded number of fetches against Fedora.
+const maxRanges = 100
+
+// parseRange parses the value of a Range header, as described in
+// RFC 7233 Section 2.1, against a resource of the given size. It
+// returns one byteRange per satisfiable requested range, in the order
+// given; ranges starting at or beyond size, zero-length suffix ranges
+// and empty list elements are dropped.
+// A nil, nil result means no Range header was present (or it didn't
+// start with "bytes="), and the full resource should be sent. More
+// than maxRanges requested ranges is treated as unsatisfiable.
+func parseRange(s string, size int64) ([]byteRange, error) {
+	if s == "" {
+		return nil, nil
+	}
+	const prefix = "bytes="
+	if !strings.HasPrefix(s, prefix) {
+		return nil, nil
+	}
+	segments := strings.Split(s[len(prefix):], ",")
+	if len(segments) > maxRanges {
+		return nil, errNoOverlap
+	}
+	var ranges []byteRange
+	noOverlap := false
+	for _, ra := range segments {
+		ra = strings.TrimSpace(ra)
+		if ra == "" {
+			continue
+		}
+		parts := strings.SplitN(ra, "-", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("disseminator: invalid range")
+		}
+		start, end := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		var r byteRange
+		if start == "" {
+			// suffix range: "-N" means the last N bytes
+			i, err := strconv.ParseInt(end, 10, 64)
+			if err != nil || i < 0 {
+				return nil, errors.New("disseminator: invalid range")
+			}
+			if i == 0 {
+				// a zero-length suffix has no overlap with the
+				// resource, rather than being a valid empty range
+				noOverlap = true
+				continue
+			}
+			if i > size {
+				i = size
+			}
+			r.start = size - i
+			r.end = size - 1
+		} else {
+			i, err := strconv.ParseInt(start, 10, 64)
+			if err != nil || i < 0 {
+				return nil, errors.New("disseminator: invalid range")
+			}
+			if i >= size {
+				noOverlap = true
+				continue
+			}
+			r.start = i
+			if end == "" {
+				r.end = size - 1
+			} else {
+				j, err := strconv.ParseInt(end, 10, 64)
+				if err != nil || i > j {
+					return nil, errors.New("disseminator: invalid range")
+				}
+				if j >= size {
+					j = size - 1
+				}
+				r.end = j
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	if noOverlap && len(ranges) == 0 {
+		return nil, errNoOverlap
+	}
+	return ranges, nil
+}
@@ -0,0 +1,46 @@
+// Package fedora provides a thin client over the parts of the Fedora
+// Commons REST API that disadis needs: fetching datastream metadata and
+// streaming datastream content.
+package fedora
+
+import (
+	"errors"
+	"io"
+)
+
+// FedoraNotFound is returned by the Fedora methods when the object or
+// datastream does not exist.
+var FedoraNotFound = errors.New("fedora: not found")
+
+// DsInfo holds the metadata Fedora returns for a datastream, as parsed
+// out of the `datastream` profile XML.
+type DsInfo struct {
+	Type      string // MIME content type
+	Length    string // length in bytes, as a decimal string
+	Label     string // the datastream label, used as a download filename
+	VersionID string // e.g. "DS1.0", used verbatim as our ETag
+}
+
+// Fedora is the interface disadis uses to talk to a Fedora repository.
+// It is implemented by Remote, and may be mocked out in tests.
+type Fedora interface {
+	// GetDatastreamInfo returns the current metadata for the given
+	// datastream, without fetching its content.
+	GetDatastreamInfo(pid, ds string) (DsInfo, error)
+
+	// GetDatastream returns the content of the given datastream, along
+	// with its metadata.
+	GetDatastream(pid, ds string) (io.ReadCloser, DsInfo, error)
+
+	// GetDatastreamRange is like GetDatastream except it only returns
+	// the `length` bytes starting at byte offset `start`. A negative
+	// length means "to the end of the datastream". Implementations
+	// should pass the range through to Fedora's REST API rather than
+	// fetching and discarding the leading bytes.
+	GetDatastreamRange(pid, ds string, start, length int64) (io.ReadCloser, DsInfo, error)
+
+	// GetContentRange is like GetDatastreamRange but skips fetching the
+	// datastream profile, for callers that already have it (e.g. from
+	// an earlier GetDatastreamInfo call) and only need more content.
+	GetContentRange(pid, ds string, start, length int64) (io.ReadCloser, error)
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.google.com/p/gcfg"
+
+	"github.com/dbrower/disadis/auth"
+	"github.com/dbrower/disadis/cache"
+	"github.com/dbrower/disadis/fedora"
+	"github.com/dbrower/disadis/queueing"
+)
+
+// portHandler is an http.Handler whose routing table can be replaced
+// atomically. A config reload builds an entirely new table (complete
+// with its own auth chain) and swaps it in; requests already being
+// served see the table they started with, and new requests see the
+// new one as soon as the swap completes.
+type portHandler struct {
+	current atomic.Value // http.Handler
+}
+
+func newPortHandler(h http.Handler) *portHandler {
+	ph := &portHandler{}
+	ph.current.Store(h)
+	return ph
+}
+
+func (ph *portHandler) set(h http.Handler) {
+	ph.current.Store(h)
+}
+
+func (ph *portHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ph.current.Load().(http.Handler).ServeHTTP(w, r)
+}
+
+type runningPort struct {
+	handler *portHandler
+	srv     *http.Server
+}
+
+// lifecycle owns the set of running per-port servers and knows how to
+// start them, reload them from the config file on SIGHUP, and shut
+// them all down gracefully.
+type lifecycle struct {
+	configFile string
+	fedoraAddr string
+	grace      atomic.Value // time.Duration; may be updated by Reload
+	logw       Reopener
+	fedora     fedora.Fedora
+	cache      *cache.Cache
+
+	mu    sync.Mutex
+	ports map[string]*runningPort
+
+	// railsDB and railsDSN hold the database pool behind Rails-cookie
+	// auth, if configured, so a reload can reuse it when the DSN is
+	// unchanged and close it when it is, instead of leaking a new pool
+	// on every SIGHUP. Guarded by mu.
+	railsDB  *sql.DB
+	railsDSN string
+}
+
+func newLifecycle(configFile, fedoraAddr string, grace time.Duration, logw Reopener, f fedora.Fedora, c *cache.Cache) *lifecycle {
+	lc := &lifecycle{
+		configFile: configFile,
+		fedoraAddr: fedoraAddr,
+		logw:       logw,
+		fedora:     f,
+		cache:      c,
+		ports:      make(map[string]*runningPort),
+	}
+	lc.grace.Store(grace)
+	return lc
+}
+
+// Start builds the handler tables described by config and starts a
+// listener for each port.
+func (lc *lifecycle) Start(config Config) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	for port, mux := range lc.buildMuxes(config) {
+		lc.startPortLocked(port, mux)
+	}
+}
+
+// startPortLocked must be called with lc.mu held.
+func (lc *lifecycle) startPortLocked(port string, mux http.Handler) {
+	ph := newPortHandler(mux)
+	srv := &http.Server{Addr: ":" + port, Handler: inFlightHandler(port, ph)}
+	lc.ports[port] = &runningPort{handler: ph, srv: srv}
+	go func() {
+		log.Printf("Listening on port %s", port)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("Error serving port %s: %s", port, err)
+		}
+	}()
+}
+
+// Reload re-reads the config file and brings the running servers in
+// line with it: ports no longer present are drained and closed, new
+// ports are started, and ports present in both have their routing
+// table (including the auth chain) swapped in atomically, without
+// dropping their listener or any connection already being served. A
+// changed shutdown_grace takes effect immediately, for any drain or
+// Shutdown that happens afterward.
+func (lc *lifecycle) Reload() {
+	if lc.configFile == "" {
+		log.Println("No --config file was given; ignoring SIGHUP")
+		return
+	}
+
+	lc.logw.Reopen()
+
+	var config Config
+	if err := gcfg.ReadFileInto(&config, lc.configFile); err != nil {
+		log.Println("Error reloading config, keeping current handlers:", err)
+		return
+	}
+	if config.General.Log_format != "" {
+		setAccessLogFormat(config.General.Log_format)
+	}
+	if config.General.Shutdown_grace != "" {
+		if d, err := time.ParseDuration(config.General.Shutdown_grace); err != nil {
+			log.Printf("Invalid shutdown_grace %q, keeping previous value", config.General.Shutdown_grace)
+		} else {
+			lc.grace.Store(d)
+		}
+	}
+
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	muxes := lc.buildMuxes(config)
+
+	for port, mux := range muxes {
+		if rp, ok := lc.ports[port]; ok {
+			rp.handler.set(mux)
+			log.Printf("Reloaded handlers on port %s", port)
+			continue
+		}
+		lc.startPortLocked(port, mux)
+	}
+
+	for port, rp := range lc.ports {
+		if _, ok := muxes[port]; ok {
+			continue
+		}
+		log.Printf("Port %s removed from config; draining", port)
+		delete(lc.ports, port)
+		go lc.drain(port, rp.srv)
+	}
+}
+
+func (lc *lifecycle) drain(port string, srv *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), lc.grace.Load().(time.Duration))
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Error closing port %s: %s", port, err)
+	}
+}
+
+// Shutdown gracefully stops every running server, giving in-flight
+// downloads up to the configured grace period to finish.
+func (lc *lifecycle) Shutdown() {
+	lc.mu.Lock()
+	ports := lc.ports
+	lc.ports = make(map[string]*runningPort)
+	if lc.railsDB != nil {
+		lc.railsDB.Close()
+		lc.railsDB = nil
+	}
+	lc.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for port, rp := range ports {
+		wg.Add(1)
+		go func(port string, rp *runningPort) {
+			defer wg.Done()
+			lc.drain(port, rp.srv)
+		}(port, rp)
+	}
+	wg.Wait()
+}
+
+// buildMuxes constructs the per-port routing table described by
+// config, including a freshly built auth chain. Its result can be
+// handed to a running portHandler (on reload) or used to start new
+// ones (on initial startup). Building the auth chain may open, reuse
+// or close lc's Rails database pool (see buildHydraAuth), so it must
+// be called with lc.mu held.
+func (lc *lifecycle) buildMuxes(config Config) map[string]*DsidMux {
+	ha := lc.buildHydraAuth(config)
+	userFunc := noUser
+	if ha.CurrentUser != nil {
+		userFunc = ha.CurrentUser.User
+	}
+
+	muxes := make(map[string]*DsidMux)
+	for k, v := range config.Handler {
+		h := &DownloadHandler{
+			Fedora:      lc.fedora,
+			Ds:          v.Datastream,
+			Versioned:   v.Versioned,
+			Prefix:      v.Prefix,
+			Queue:       buildQueue(k, config, v),
+			Cache:       lc.cache,
+			PublicCache: v.Public_cache,
+			CacheMaxAge: v.Cache_max_age,
+		}
+		if v.Auth {
+			h.Auth = handlerAuth(ha, v)
+		}
+		log.Printf("Handler %s (datastream %s, port %s, auth %v, dsid %v)",
+			k, v.Datastream, v.Port, v.Auth, v.Datastream_id)
+
+		mux, ok := muxes[v.Port]
+		if !ok {
+			mux = &DsidMux{}
+			muxes[v.Port] = mux
+		}
+		hh := accessLogHandler(k, h, userFunc)
+		if len(v.Datastream_id) == 0 {
+			mux.DefaultHandler = hh
+		}
+		for _, name := range v.Datastream_id {
+			if name == "default" {
+				mux.DefaultHandler = hh
+			} else {
+				mux.AddHandler(name, hh)
+			}
+		}
+	}
+	return muxes
+}
+
+// buildQueue returns the queue which bounds handler k's access to
+// Fedora, keyed by name so a hot datastream can't starve others.
+// max_concurrency <= 0 (on both the handler and General) means no
+// queueing is done at all.
+func buildQueue(name string, config Config, v *HandlerConfig) *queueing.Queue {
+	maxConcurrency := v.Max_concurrency
+	if maxConcurrency == 0 {
+		maxConcurrency = config.General.Max_concurrency
+	}
+	if maxConcurrency <= 0 {
+		return nil
+	}
+	maxQueueLength := v.Max_queue_length
+	if maxQueueLength == 0 {
+		maxQueueLength = config.General.Max_queue_length
+	}
+	timeoutStr := v.Queue_timeout
+	if timeoutStr == "" {
+		timeoutStr = config.General.Queue_timeout
+	}
+	var timeout time.Duration
+	if timeoutStr != "" {
+		d, err := time.ParseDuration(timeoutStr)
+		if err != nil {
+			log.Printf("Invalid queue_timeout %q for handler %s, ignoring", timeoutStr, name)
+		} else {
+			timeout = d
+		}
+	}
+	return queueing.New(name, maxConcurrency, maxQueueLength, timeout)
+}
+
+// handlerAuth returns the HydraAuth to install on a handler for v. If
+// ha's CurrentUser is a SignedURLAuth, a shallow copy is returned with
+// Ds set to v's datastream, since a signature must cover the specific
+// datastream it grants access to; otherwise ha is shared unchanged.
+func handlerAuth(ha *auth.HydraAuth, v *HandlerConfig) *auth.HydraAuth {
+	sa, ok := ha.CurrentUser.(*auth.SignedURLAuth)
+	if !ok {
+		return ha
+	}
+	clone := *sa
+	clone.Ds = v.Datastream
+	haCopy := *ha
+	haCopy.CurrentUser = &clone
+	return &haCopy
+}
+
+// buildHydraAuth constructs the auth chain described by config.
+// General.Admin and config.Pubtkt/config.Rails/config.Signedurl. It is
+// a method, rather than a free function, because Rails-cookie auth
+// needs access to lc's database pool across reloads: see railsDBFor.
+func (lc *lifecycle) buildHydraAuth(config Config) *auth.HydraAuth {
+	ha := auth.NewHydraAuth(lc.fedoraAddr, "")
+	ha.Admin = config.General.Admin
+	log.Println("Admin users:", ha.Admin)
+	usedRailsDB := false
+	switch {
+	case config.Signedurl.Secret != "":
+		log.Printf("Using signed download URLs")
+		maxTTL, err := time.ParseDuration(config.Signedurl.Max_ttl)
+		if config.Signedurl.Max_ttl != "" && err != nil {
+			log.Printf("Invalid signedurl max_ttl %q, ignoring", config.Signedurl.Max_ttl)
+			maxTTL = 0
+		}
+		ha.CurrentUser = &auth.SignedURLAuth{
+			Secret: []byte(config.Signedurl.Secret),
+			MaxTTL: maxTTL,
+			BindIP: config.Signedurl.Bind_ip,
+		}
+	case config.Pubtkt.Key_file != "":
+		log.Printf("Using pubtkt %s", config.Pubtkt.Key_file)
+		ha.CurrentUser = auth.NewPubtktAuthFromKeyFile(config.Pubtkt.Key_file)
+	case config.Rails.Secret != "":
+		log.Printf("Using Rails 3 cookies")
+		if config.Rails.Cookie == "" {
+			log.Printf("Warning: The name of the cookie holding the rails session is required")
+			break
+		}
+		if config.Rails.Database == "" {
+			log.Printf("Warning: A database is required to use rails cookies")
+			break
+		}
+		db, err := lc.railsDBFor(config.Rails.Database)
+		if err != nil {
+			log.Printf("Error opening database connection: %s", err)
+			break
+		}
+		usedRailsDB = true
+		ha.CurrentUser = &auth.DeviseAuth{
+			SecretBase: []byte(config.Rails.Secret),
+			CookieName: config.Rails.Cookie,
+			Lookup:     &auth.DatabaseUser{Db: db},
+		}
+	default:
+		log.Printf("Warning: No authorization method given.")
+	}
+	if !usedRailsDB && lc.railsDB != nil {
+		// Rails-cookie auth was in use before this reload but isn't
+		// anymore: close the pool instead of leaking it.
+		lc.railsDB.Close()
+		lc.railsDB = nil
+		lc.railsDSN = ""
+	}
+	if ha.CurrentUser == nil {
+		log.Printf("Warning: No way to identify requesters; allowing every request.")
+	}
+	return ha
+}
+
+// railsDBFor returns a *sql.DB for database, reusing lc's existing pool
+// if its DSN hasn't changed since the last call, and closing the old
+// pool otherwise. This keeps repeated SIGHUP reloads from opening a
+// fresh connection pool every time. Must be called with lc.mu held.
+func (lc *lifecycle) railsDBFor(database string) (*sql.DB, error) {
+	if lc.railsDB != nil && lc.railsDSN == database {
+		return lc.railsDB, nil
+	}
+	db, err := openRailsDB(database)
+	if err != nil {
+		return nil, err
+	}
+	if lc.railsDB != nil {
+		lc.railsDB.Close()
+	}
+	lc.railsDB = db
+	lc.railsDSN = database
+	return db, nil
+}
@@ -0,0 +1,159 @@
+// Package metrics holds the Prometheus instrumentation shared across
+// disadis: the main process, the disseminator handlers, and the fedora
+// client all record into these same metrics so a single /metrics
+// endpoint can expose the whole pipeline.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// RequestsTotal counts handled requests, by handler, method and
+	// response status.
+	RequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "disadis_requests_total",
+			Help: "Total number of requests handled, by handler, method and status",
+		},
+		[]string{"handler", "method", "status"},
+	)
+
+	// RequestDuration records end-to-end request latency, by handler.
+	RequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "disadis_request_duration_seconds",
+			Help:    "Request latency in seconds, by handler",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"handler"},
+	)
+
+	// BytesServed counts response bytes written to clients, by handler.
+	BytesServed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "disadis_bytes_served_total",
+			Help: "Total bytes written to clients, by handler",
+		},
+		[]string{"handler"},
+	)
+
+	// FedoraLatency records the latency of calls made to Fedora, by
+	// method ("info" or "content").
+	FedoraLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "disadis_fedora_request_duration_seconds",
+			Help:    "Latency of calls made to Fedora, in seconds, by method",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"method"},
+	)
+
+	// AuthDecisions counts authorization outcomes, by outcome
+	// ("allow", "deny", "notfound", "gone", "error").
+	AuthDecisions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "disadis_auth_decisions_total",
+			Help: "Authorization decisions, by outcome",
+		},
+		[]string{"outcome"},
+	)
+
+	// InFlight tracks the number of requests currently being served,
+	// by listening port.
+	InFlight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "disadis_in_flight_requests",
+			Help: "Number of requests currently being served, by port",
+		},
+		[]string{"port"},
+	)
+
+	// QueueDepth tracks requests currently waiting for a Fedora
+	// concurrency slot, by queue name.
+	QueueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "disadis_queue_depth",
+			Help: "Requests currently waiting for a Fedora concurrency slot, by queue",
+		},
+		[]string{"queue"},
+	)
+
+	// QueueInFlight tracks requests currently holding a Fedora
+	// concurrency slot, by queue name.
+	QueueInFlight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "disadis_queue_in_flight",
+			Help: "Requests currently holding a Fedora concurrency slot, by queue",
+		},
+		[]string{"queue"},
+	)
+
+	// QueueRejected counts requests rejected by a queue, either
+	// because its waiting room was full or because they timed out
+	// waiting for a slot.
+	QueueRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "disadis_queue_rejected_total",
+			Help: "Total requests rejected by a queue, by queue",
+		},
+		[]string{"queue"},
+	)
+
+	// QueueWaitSeconds records how long a request waited for a
+	// concurrency slot before being served, by queue name.
+	QueueWaitSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "disadis_queue_wait_seconds",
+			Help:    "Time spent waiting for a Fedora concurrency slot, by queue",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"queue"},
+	)
+
+	// CacheHits counts requests served from the on-disk content cache.
+	CacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "disadis_cache_hits_total",
+		Help: "Total requests served from the on-disk content cache",
+	})
+
+	// CacheMisses counts requests for which the on-disk content cache
+	// had no entry.
+	CacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "disadis_cache_misses_total",
+		Help: "Total requests not found in the on-disk content cache",
+	})
+
+	// CacheBytesServed counts response bytes written to clients from
+	// the on-disk content cache.
+	CacheBytesServed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "disadis_cache_bytes_served_total",
+		Help: "Total bytes written to clients from the on-disk content cache",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		RequestsTotal,
+		RequestDuration,
+		BytesServed,
+		FedoraLatency,
+		AuthDecisions,
+		InFlight,
+		QueueDepth,
+		QueueInFlight,
+		QueueRejected,
+		QueueWaitSeconds,
+		CacheHits,
+		CacheMisses,
+		CacheBytesServed,
+	)
+}
+
+// Handler returns the http.Handler to serve on the metrics port.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/dbrower/disadis/metrics"
+)
+
+// serveMetrics starts a listener serving the Prometheus /metrics
+// endpoint on port. It is deliberately separate from the pprof port
+// (hardcoded at 6060) so metrics can be exposed to a monitoring system
+// without also exposing pprof. A blank port disables it.
+func serveMetrics(port string) {
+	if port == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	log.Printf("Serving Prometheus metrics on port %s", port)
+	go http.ListenAndServe(":"+port, mux)
+}
+
+// inFlightHandler wraps h to track the number of requests currently
+// being served on the given port.
+func inFlightHandler(port string, h http.Handler) http.Handler {
+	g := metrics.InFlight.WithLabelValues(port)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.Inc()
+		defer g.Dec()
+		h.ServeHTTP(w, r)
+	})
+}
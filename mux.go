@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DsidMux dispatches requests to one of several handlers based on the
+// first path component, which is taken to be a datastream id. This
+// lets several differently-configured DownloadHandlers (e.g. one for
+// thumbnails, one for the full object) share a single port.
+//
+//	/tn/:pid    -> handler registered under "tn", request rewritten to /:pid
+//	/:pid       -> DefaultHandler, request unchanged
+//
+// The zero value is usable, and has no registered handlers.
+type DsidMux struct {
+	// DefaultHandler serves any request which does not match one of
+	// the registered datastream ids. May be nil.
+	DefaultHandler http.Handler
+
+	handlers map[string]http.Handler
+}
+
+// AddHandler registers h to serve requests whose first path component
+// is name.
+func (dm *DsidMux) AddHandler(name string, h http.Handler) {
+	if dm.handlers == nil {
+		dm.handlers = make(map[string]http.Handler)
+	}
+	dm.handlers[name] = h
+}
+
+func (dm *DsidMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	dsid, rest, found := cutPath(path)
+	if found {
+		if h, ok := dm.handlers[dsid]; ok {
+			r2 := cloneRequestWithPath(r, "/"+rest)
+			h.ServeHTTP(w, r2)
+			return
+		}
+	}
+	if dm.DefaultHandler != nil {
+		dm.DefaultHandler.ServeHTTP(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func cutPath(path string) (head, rest string, found bool) {
+	i := strings.Index(path, "/")
+	if i == -1 {
+		return "", "", false
+	}
+	return path[:i], path[i+1:], true
+}
+
+// cloneRequestWithPath returns a shallow copy of r with its URL path
+// replaced, so the wrapped handler sees only the portion of the path
+// after the datastream id.
+func cloneRequestWithPath(r *http.Request, path string) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	u2 := new(url.URL)
+	*u2 = *r.URL
+	u2.Path = path
+	r2.URL = u2
+	return r2
+}
@@ -0,0 +1,19 @@
+package queueing
+
+import (
+	"time"
+
+	"github.com/dbrower/disadis/metrics"
+)
+
+func recordQueued(name string)   { metrics.QueueDepth.WithLabelValues(name).Inc() }
+func recordDequeued(name string) { metrics.QueueDepth.WithLabelValues(name).Dec() }
+func recordRejected(name string) { metrics.QueueRejected.WithLabelValues(name).Inc() }
+
+func recordInFlight(name string, delta float64) {
+	metrics.QueueInFlight.WithLabelValues(name).Add(delta)
+}
+
+func recordWait(name string, d time.Duration) {
+	metrics.QueueWaitSeconds.WithLabelValues(name).Observe(d.Seconds())
+}
@@ -0,0 +1,112 @@
+// Package queueing provides a bounded work queue to put in front of a
+// fragile upstream (Fedora): only a limited number of requests may be
+// in flight at once, a limited number more may wait their turn, and
+// everything else is rejected immediately rather than piling up.
+//
+// This mirrors the queueing approach used by gitlab-workhorse's
+// internal/queueing package.
+package queueing
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrQueueFull is returned by Acquire when the waiting room is
+// already at capacity.
+var ErrQueueFull = errors.New("queueing: queue is full")
+
+// ErrTimeout is returned by Acquire when a waiting slot was available,
+// but no concurrency slot opened up before the queue timeout elapsed.
+var ErrTimeout = errors.New("queueing: timed out waiting for a slot")
+
+// Queue bounds concurrent access to some resource: at most
+// maxConcurrency callers may hold a slot at once, at most
+// maxQueueLength more may be waiting for one, and a caller which has
+// been waiting longer than timeout gives up.
+type Queue struct {
+	name    string
+	timeout time.Duration
+	sem     chan struct{}
+	waiting chan struct{}
+}
+
+// New returns a Queue identified by name (used only to label its
+// metrics). A maxQueueLength of 0 means no one may wait: callers beyond
+// maxConcurrency are either served immediately, if a concurrency slot
+// is free, or rejected outright. A timeout of 0 means callers wait
+// indefinitely for a concurrency slot once they have a waiting room
+// slot.
+func New(name string, maxConcurrency, maxQueueLength int, timeout time.Duration) *Queue {
+	if maxConcurrency < 1 {
+		maxConcurrency = 1
+	}
+	if maxQueueLength < 0 {
+		maxQueueLength = 0
+	}
+	return &Queue{
+		name:    name,
+		timeout: timeout,
+		sem:     make(chan struct{}, maxConcurrency),
+		waiting: make(chan struct{}, maxQueueLength),
+	}
+}
+
+// Acquire blocks the caller until a concurrency slot is free, the
+// timeout elapses, or the waiting room is already full. On success it
+// returns a release func which must be called to free the slot.
+func (q *Queue) Acquire() (release func(), err error) {
+	// Try for a concurrency slot before claiming a waiting room slot,
+	// so that a maxQueueLength of 0 still admits up to maxConcurrency
+	// callers instead of rejecting everyone.
+	select {
+	case q.sem <- struct{}{}:
+		recordInFlight(q.name, 1)
+		return func() {
+			recordInFlight(q.name, -1)
+			<-q.sem
+		}, nil
+	default:
+	}
+
+	select {
+	case q.waiting <- struct{}{}:
+	default:
+		recordRejected(q.name)
+		return nil, ErrQueueFull
+	}
+	defer func() { <-q.waiting }()
+
+	recordQueued(q.name)
+	defer recordDequeued(q.name)
+
+	start := time.Now()
+	var timeoutCh <-chan time.Time
+	if q.timeout > 0 {
+		timer := time.NewTimer(q.timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+
+	select {
+	case q.sem <- struct{}{}:
+		recordWait(q.name, time.Since(start))
+		recordInFlight(q.name, 1)
+		return func() {
+			recordInFlight(q.name, -1)
+			<-q.sem
+		}, nil
+	case <-timeoutCh:
+		recordRejected(q.name)
+		return nil, ErrTimeout
+	}
+}
+
+// RetryAfter is the value callers should advertise in a Retry-After
+// header when Acquire fails.
+func (q *Queue) RetryAfter() time.Duration {
+	if q.timeout > 0 {
+		return q.timeout
+	}
+	return time.Second
+}
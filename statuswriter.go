@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/dbrower/disadis/auth"
+)
+
+// statusWriter wraps an http.ResponseWriter to capture the status code
+// and byte count of a response, for access logging and metrics. It also
+// implements auth.UserRecorder, so a handler's HydraAuth.Check can
+// record the identity it already determined for access logging to
+// reuse, rather than it being looked up a second time.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+
+	user    auth.User
+	hasUser bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// SetUser records the identity of the requester, per auth.UserRecorder.
+func (w *statusWriter) SetUser(u auth.User) {
+	w.user = u
+	w.hasUser = true
+}